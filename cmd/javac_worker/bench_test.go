@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+// These benchmarks compare the cost of compiling through a fresh JVM each time against reusing a
+// single warm WorkerMain subprocess, the difference TransformJavaToClasses is meant to amortize
+// over an incremental build (see java/builder.go's javacWorker rule). They need a real `javac` on
+// $PATH and a compiled WorkerMain.class on startWorker's default classpath ("."). They're skipped
+// rather than faked when javac isn't on $PATH, instead of asserting a canned speedup number; a
+// WorkerMain that can't be started makes them fail.
+
+func requireJavac(b *testing.B) {
+	if _, err := exec.LookPath("javac"); err != nil {
+		b.Skip("javac not found on $PATH, skipping JVM warm-worker benchmark")
+	}
+}
+
+// BenchmarkColdJVMPerCompile starts a fresh javac process for every compile, the behavior of the
+// plain (non-worker) javac rule.
+func BenchmarkColdJVMPerCompile(b *testing.B) {
+	requireJavac(b)
+
+	for i := 0; i < b.N; i++ {
+		opts := options{javaCmd: "java", passthrough: []string{"-version"}}
+		if exit := runOneShotUncached(opts); exit != 0 {
+			b.Fatalf("javac -version exited %d", exit)
+		}
+	}
+}
+
+// BenchmarkWarmWorkerPerCompile reuses a single WorkerMain subprocess across every iteration, the
+// behavior of the javacWorker rule when SOONG_JAVAC_WORKERS=1.
+func BenchmarkWarmWorkerPerCompile(b *testing.B) {
+	requireJavac(b)
+
+	opts := options{javaCmd: "java"}
+	w, err := startWorker(opts)
+	if err != nil {
+		b.Fatalf("startWorker: %v", err)
+	}
+	defer w.stop()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.compile(request{Args: []string{"-version"}}); err != nil {
+			b.Fatalf("compile: %v", err)
+		}
+	}
+}
+
+// runOneShotUncached mirrors runOneShot but makes the per-call worker startup explicit for the
+// cold-JVM benchmark above, rather than reusing the one runOneShot already starts and stops.
+func runOneShotUncached(opts options) int {
+	w, err := startWorker(opts)
+	if err != nil {
+		return 1
+	}
+	defer w.stop()
+
+	resp, err := w.compile(request{Args: opts.passthrough, Errorprone: opts.errorprone})
+	if err != nil {
+		return 1
+	}
+	return resp.ExitCode
+}
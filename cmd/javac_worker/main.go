@@ -0,0 +1,385 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// javac_worker is a thin client/daemon pair that lets Ninja build actions reuse a warm JVM across
+// invocations of javac and Error Prone, instead of paying JVM startup cost on every compilation.
+// Ninja has no notion of a persistent worker, so this binary plays both roles: the one-shot CLI
+// that Ninja actually execs, and (transparently, the first time it's needed) the long-lived
+// daemon that CLI invocation talks to over a Unix domain socket. The daemon itself doesn't run
+// javac in-process (Go can't load a JVM); instead it keeps a single WorkerMain JVM subprocess
+// (see worker/WorkerMain.java) alive for its whole lifetime and pipes requests to its stdin,
+// so the actual javac/Error Prone classes stay loaded and warm across calls.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// idleTimeout is how long the daemon waits without a request before exiting.
+	idleTimeout = 5 * time.Minute
+	// dialTimeout bounds how long the one-shot client waits for an existing daemon to accept
+	// a connection before deciding it needs to spawn a new one.
+	dialTimeout = 2 * time.Second
+)
+
+// request is one compilation request sent from the one-shot client to the daemon, and from the
+// daemon to its WorkerMain subprocess.
+type request struct {
+	Args       []string `json:"args"`
+	Errorprone bool     `json:"errorprone"`
+}
+
+// response is the reply to a request, from WorkerMain to the daemon and from the daemon to the
+// one-shot client.
+type response struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+// options holds the result of parsing argv.  javac/errorprone flags (-source, -d, -classpath,
+// ...) are never recognized here: parseArgs stops at the first token it doesn't own and passes
+// everything from there on through untouched, so this can't be built on the standard "flag"
+// package, which aborts on any argument it doesn't recognize.
+type options struct {
+	persistentWorker bool
+	daemon           bool
+	errorprone       bool
+	sockPath         string
+	javaCmd          string
+	workerClasspath  string
+	passthrough      []string
+}
+
+func parseArgs(argv []string) options {
+	opts := options{
+		sockPath: defaultSockPath(),
+		javaCmd:  "java",
+	}
+
+	i := 0
+	for ; i < len(argv); i++ {
+		a := argv[i]
+		switch {
+		case a == "--persistent_worker":
+			opts.persistentWorker = true
+		case a == "--daemon":
+			opts.daemon = true
+		case a == "--errorprone":
+			opts.errorprone = true
+		case a == "--worker_sock":
+			i++
+			if i < len(argv) {
+				opts.sockPath = argv[i]
+			}
+		case strings.HasPrefix(a, "--worker_sock="):
+			opts.sockPath = strings.TrimPrefix(a, "--worker_sock=")
+		case a == "--java_cmd":
+			i++
+			if i < len(argv) {
+				opts.javaCmd = argv[i]
+			}
+		case strings.HasPrefix(a, "--java_cmd="):
+			opts.javaCmd = strings.TrimPrefix(a, "--java_cmd=")
+		case a == "--worker_classpath":
+			i++
+			if i < len(argv) {
+				opts.workerClasspath = argv[i]
+			}
+		case strings.HasPrefix(a, "--worker_classpath="):
+			opts.workerClasspath = strings.TrimPrefix(a, "--worker_classpath=")
+		default:
+			opts.passthrough = argv[i:]
+			return opts
+		}
+	}
+	return opts
+}
+
+func main() {
+	opts := parseArgs(os.Args[1:])
+
+	if opts.daemon {
+		if err := runDaemon(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "javac_worker: daemon exited: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !opts.persistentWorker {
+		os.Exit(runOneShot(opts))
+	}
+
+	os.Exit(runViaDaemon(opts))
+}
+
+func defaultSockPath() string {
+	outDir := os.Getenv("OUT_DIR")
+	if outDir == "" {
+		outDir = "out"
+	}
+	return filepath.Join(outDir, ".soong", "javac-worker.sock")
+}
+
+// runViaDaemon forwards opts.passthrough to the daemon at opts.sockPath, spawning the daemon if
+// it isn't already listening, and returns the process exit code the caller should use.
+func runViaDaemon(opts options) int {
+	conn, err := net.DialTimeout("unix", opts.sockPath, dialTimeout)
+	if err != nil {
+		if err := spawnDaemon(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "javac_worker: failed to start daemon: %v\n", err)
+			return 1
+		}
+		conn, err = waitForDaemon(opts.sockPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "javac_worker: daemon did not come up: %v\n", err)
+			return 1
+		}
+	}
+	defer conn.Close()
+
+	req := request{Args: opts.passthrough, Errorprone: opts.errorprone}
+
+	if err := writeMessage(conn, req); err != nil {
+		fmt.Fprintf(os.Stderr, "javac_worker: failed to send request: %v\n", err)
+		return 1
+	}
+
+	var resp response
+	if err := readMessage(conn, &resp); err != nil {
+		fmt.Fprintf(os.Stderr, "javac_worker: failed to read response: %v\n", err)
+		return 1
+	}
+
+	os.Stdout.WriteString(resp.Stdout)
+	os.Stderr.WriteString(resp.Stderr)
+	return resp.ExitCode
+}
+
+// spawnDaemon starts a detached copy of this binary in daemon mode and returns once it has been
+// launched; it does not wait for the daemon to finish coming up.
+func spawnDaemon(opts options) error {
+	if err := os.MkdirAll(filepath.Dir(opts.sockPath), 0777); err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--daemon", "--worker_sock", opts.sockPath, "--java_cmd", opts.javaCmd}
+	if opts.workerClasspath != "" {
+		args = append(args, "--worker_classpath", opts.workerClasspath)
+	}
+
+	cmd := exec.Command(self, args...)
+	return cmd.Start()
+}
+
+func waitForDaemon(sockPath string) (net.Conn, error) {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.DialTimeout("unix", sockPath, dialTimeout); err == nil {
+			return conn, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timed out waiting for %s", sockPath)
+}
+
+// runOneShot runs a single compilation without going through the daemon, matching the behavior of
+// the plain javac/errorprone rules.  This is used when javac_worker is run without
+// --persistent_worker; when SOONG_JAVAC_WORKERS is unset the build runs the plain rules and does
+// not invoke javac_worker at all.
+func runOneShot(opts options) int {
+	w, err := startWorker(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "javac_worker: %v\n", err)
+		return 1
+	}
+	defer w.stop()
+
+	resp, err := w.compile(request{Args: opts.passthrough, Errorprone: opts.errorprone})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "javac_worker: %v\n", err)
+		return 1
+	}
+
+	os.Stdout.WriteString(resp.Stdout)
+	os.Stderr.WriteString(resp.Stderr)
+	return resp.ExitCode
+}
+
+// runDaemon listens on opts.sockPath, serving compile requests by forwarding them to a single
+// WorkerMain subprocess that it keeps alive for the daemon's whole lifetime, until idleTimeout
+// elapses between requests, at which point it exits so an idle supervisor doesn't have to kill it
+// explicitly.
+func runDaemon(opts options) error {
+	os.Remove(opts.sockPath)
+
+	l, err := net.Listen("unix", opts.sockPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	w, err := startWorker(opts)
+	if err != nil {
+		return err
+	}
+	defer w.stop()
+
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+	conns := make(chan accepted)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			conns <- accepted{conn, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case a := <-conns:
+			if a.err != nil {
+				return a.err
+			}
+			serveOne(a.conn, w)
+		case <-time.After(idleTimeout):
+			return nil
+		}
+	}
+}
+
+// serveOne handles a single client connection.  Requests are served one at a time against the
+// shared WorkerMain process, which is itself single-threaded, rather than concurrently.
+func serveOne(conn net.Conn, w *worker) {
+	defer conn.Close()
+
+	var req request
+	if err := readMessage(conn, &req); err != nil {
+		return
+	}
+
+	resp, err := w.compile(req)
+	if err != nil {
+		resp = response{ExitCode: 1, Stderr: err.Error()}
+	}
+
+	writeMessage(conn, resp)
+}
+
+// worker wraps a single long-lived WorkerMain JVM subprocess, communicating with it over its
+// stdin/stdout using the same length-delimited JSON framing used between this CLI and the daemon.
+// Keeping the subprocess alive across many compile() calls is what actually avoids paying JVM
+// startup and class-loading cost per compilation.
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startWorker(opts options) (*worker, error) {
+	classpath := opts.workerClasspath
+	if classpath == "" {
+		classpath = "."
+	}
+
+	cmd := exec.Command(opts.javaCmd, "-cp", classpath, "WorkerMain")
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &worker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+func (w *worker) compile(req request) (response, error) {
+	if err := writeMessage(w.stdin, req); err != nil {
+		return response{}, fmt.Errorf("sending request to worker: %w", err)
+	}
+
+	var resp response
+	if err := readMessage(w.stdout, &resp); err != nil {
+		return response{}, fmt.Errorf("reading response from worker: %w", err)
+	}
+	return resp, nil
+}
+
+func (w *worker) stop() {
+	w.stdin.Close()
+	w.cmd.Wait()
+}
+
+// writeMessage writes v as a length-delimited JSON message, mirroring the framing of Bazel's
+// persistent worker protocol (a length-prefixed protobuf message) without requiring a protobuf
+// dependency in this tree.
+func writeMessage(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(b)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readMessage(r io.Reader, v interface{}) error {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// soong_jar_merge combines several jar files into one, used by the combineJarFast build rule in
+// place of MergeZipsCmd.  See jar.Merge for the merge semantics.
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"android/soong/jar"
+)
+
+type stripFiles []string
+
+func (s *stripFiles) String() string { return fmt.Sprint(*s) }
+
+func (s *stripFiles) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func main() {
+	out := flag.String("o", "", "output jar")
+	manifest := flag.String("m", "", "manifest file to embed as META-INF/MANIFEST.MF")
+	var strip stripFiles
+	flag.Var(&strip, "stripFile", "glob of entry names to drop from the output, may be repeated")
+	// -D mirrors MergeZipsCmd's "strip directory entries" flag. jar.Merge already always skips
+	// directory entries, so this is accepted as a no-op purely so callers that pass it through
+	// unconditionally (see TransformJarsToJar's stripDirs handling) don't hit an unknown flag.
+	flag.Bool("D", false, "accepted for compatibility with MergeZipsCmd; directory entries are always stripped")
+	flag.Parse()
+
+	if *out == "" {
+		log.Fatal("soong_jar_merge: -o is required")
+	}
+
+	opts := jar.MergeOptions{StripFiles: strip}
+	if *manifest != "" {
+		data, err := ioutil.ReadFile(*manifest)
+		if err != nil {
+			log.Fatalf("soong_jar_merge: %v", err)
+		}
+		opts.Manifest = data
+	}
+
+	var readers []*zip.Reader
+	for _, in := range flag.Args() {
+		r, err := zip.OpenReader(in)
+		if err != nil {
+			log.Fatalf("soong_jar_merge: opening %s: %v", in, err)
+		}
+		defer r.Close()
+		readers = append(readers, &r.Reader)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("soong_jar_merge: creating %s: %v", *out, err)
+	}
+	defer f.Close()
+
+	if err := jar.Merge(f, readers, opts); err != nil {
+		log.Fatalf("soong_jar_merge: %v", err)
+	}
+}
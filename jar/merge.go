@@ -0,0 +1,193 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jar implements an in-process replacement for the MergeZipsCmd/soong_zip pipeline used
+// to combine several jars into one.  Unlike shelling out to a separate merge tool, it copies each
+// entry's already-compressed bytes straight from the source zip's central directory into the
+// output via archive/zip's raw API, so combining jars that are mostly made up of previously-
+// compiled .class files doesn't pay to re-inflate and re-deflate them.  The one exception is
+// META-INF/services/* entries, which have to be decompressed so same-named entries from several
+// inputs can be concatenated rather than just copied.
+package jar
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MergeOptions controls how Merge combines its input jars.
+type MergeOptions struct {
+	// Manifest, if non-empty, is written into the output as META-INF/MANIFEST.MF, replacing any
+	// manifest entry that a dependency jar might carry.
+	Manifest []byte
+
+	// StripFiles is a list of glob patterns (matched with path.Match against both the full entry
+	// name and its base name) whose matching entries are dropped from the output.
+	StripFiles []string
+}
+
+// Merge reads the given jar readers in order and writes their combined contents to w.  Entries
+// under META-INF/services/ that share a name across inputs are concatenated, one input's lines
+// after another, instead of keeping only the first copy, so service-loader registrations
+// from every input jar keep taking effect.  All other duplicate entry names keep the first copy
+// seen, matching the precedence MergeZipsCmd gives its input list.
+func Merge(w io.Writer, readers []*zip.Reader, opts MergeOptions) error {
+	zw := zip.NewWriter(w)
+
+	// An entry is written one of two ways: raw (header + already-compressed bytes copied
+	// straight from the source, the common case), or recompressed from data (used only for
+	// META-INF/services/* concatenation and the synthesized manifest, both of which have to
+	// produce bytes that don't exist verbatim in any one input).
+	type entry struct {
+		name   string
+		header *zip.FileHeader
+		raw    []byte
+		data   []byte
+	}
+
+	seen := make(map[string]int) // name -> index into entries
+	var entries []entry
+
+	for _, r := range readers {
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+
+			if stripped(f.Name, opts.StripFiles) {
+				continue
+			}
+
+			if f.Name == "META-INF/MANIFEST.MF" && len(opts.Manifest) > 0 {
+				continue
+			}
+
+			if strings.HasPrefix(f.Name, "META-INF/services/") {
+				data, err := readEntry(f)
+				if err != nil {
+					return fmt.Errorf("jar: reading %s: %w", f.Name, err)
+				}
+				if i, ok := seen[f.Name]; ok {
+					if len(entries[i].data) > 0 && entries[i].data[len(entries[i].data)-1] != '\n' {
+						entries[i].data = append(entries[i].data, '\n')
+					}
+					entries[i].data = append(entries[i].data, data...)
+					continue
+				}
+				seen[f.Name] = len(entries)
+				entries = append(entries, entry{name: f.Name, data: data})
+				continue
+			}
+
+			if _, ok := seen[f.Name]; ok {
+				continue
+			}
+
+			raw, err := readRawEntry(f)
+			if err != nil {
+				return fmt.Errorf("jar: reading %s: %w", f.Name, err)
+			}
+			header := f.FileHeader
+			seen[f.Name] = len(entries)
+			entries = append(entries, entry{name: f.Name, header: &header, raw: raw})
+		}
+	}
+
+	if len(opts.Manifest) > 0 {
+		entries = append(entries, entry{
+			name: "META-INF/MANIFEST.MF",
+			data: opts.Manifest,
+		})
+	}
+
+	// Writing entries in sorted order, rather than input encounter order, makes the output
+	// reproducible regardless of the order ninja happens to list dependencies in.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	for _, e := range entries {
+		if e.header == nil {
+			fw, err := zw.CreateHeader(&zip.FileHeader{
+				Name:   e.name,
+				Method: zip.Deflate,
+			})
+			if err != nil {
+				return fmt.Errorf("jar: creating %s: %w", e.name, err)
+			}
+			if _, err := fw.Write(e.data); err != nil {
+				return fmt.Errorf("jar: writing %s: %w", e.name, err)
+			}
+			continue
+		}
+
+		fw, err := zw.CreateRaw(e.header)
+		if err != nil {
+			return fmt.Errorf("jar: creating %s: %w", e.name, err)
+		}
+		if _, err := fw.Write(e.raw); err != nil {
+			return fmt.Errorf("jar: writing %s: %w", e.name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// readRawEntry returns a zip entry's bytes exactly as stored in the source archive (still
+// compressed, if the source compressed it), for entries that can be copied straight into the
+// output without being touched.
+func readRawEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, rc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readEntry returns the uncompressed contents of a zip entry, for entries that need to be
+// inspected or recombined with others before being written back out.
+func readEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, rc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func stripped(name string, globs []string) bool {
+	base := path.Base(name)
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(g, base); ok {
+			return true
+		}
+	}
+	return false
+}
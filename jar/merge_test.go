@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jar
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func buildZip(t *testing.T, files map[string]string) *zip.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatalf("creating %s: %v", name, err)
+		}
+		if _, err := fw.Write([]byte(contents)); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing input zip: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reopening input zip: %v", err)
+	}
+	return r
+}
+
+func mergeToReader(t *testing.T, readers []*zip.Reader, opts MergeOptions) *zip.Reader {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := Merge(&out, readers, opts); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("opening merged zip: %v", err)
+	}
+	return r
+}
+
+func entryContents(t *testing.T, r *zip.Reader, name string) string {
+	t.Helper()
+
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", name, err)
+		}
+		defer rc.Close()
+
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(rc); err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		return buf.String()
+	}
+	t.Fatalf("merged zip has no entry %s", name)
+	return ""
+}
+
+func TestMergeCopiesEntriesRaw(t *testing.T) {
+	in := buildZip(t, map[string]string{"a/A.class": "hello"})
+
+	out := mergeToReader(t, []*zip.Reader{in}, MergeOptions{})
+
+	if got, want := len(out.File), 1; got != want {
+		t.Fatalf("len(out.File) = %d, want %d", got, want)
+	}
+
+	got, want := out.File[0], in.File[0]
+	if got.Method != want.Method {
+		t.Errorf("Method = %v, want %v", got.Method, want.Method)
+	}
+	if got.CRC32 != want.CRC32 {
+		t.Errorf("CRC32 = %x, want %x", got.CRC32, want.CRC32)
+	}
+	if got.CompressedSize64 != want.CompressedSize64 {
+		t.Errorf("CompressedSize64 = %d, want %d", got.CompressedSize64, want.CompressedSize64)
+	}
+}
+
+func TestMergeFirstJarWins(t *testing.T) {
+	a := buildZip(t, map[string]string{"a/A.class": "first"})
+	b := buildZip(t, map[string]string{"a/A.class": "second"})
+
+	out := mergeToReader(t, []*zip.Reader{a, b}, MergeOptions{})
+
+	if got, want := entryContents(t, out, "a/A.class"), "first"; got != want {
+		t.Errorf("a/A.class = %q, want %q", got, want)
+	}
+}
+
+func TestMergeConcatenatesServiceEntries(t *testing.T) {
+	a := buildZip(t, map[string]string{"META-INF/services/foo.Bar": "impl.A\n"})
+	b := buildZip(t, map[string]string{"META-INF/services/foo.Bar": "impl.B\n"})
+
+	out := mergeToReader(t, []*zip.Reader{a, b}, MergeOptions{})
+
+	want := "impl.A\nimpl.B\n"
+	if got := entryContents(t, out, "META-INF/services/foo.Bar"); got != want {
+		t.Errorf("META-INF/services/foo.Bar = %q, want %q", got, want)
+	}
+}
+
+func TestMergeStripsMatchingEntries(t *testing.T) {
+	in := buildZip(t, map[string]string{
+		"a/A.class":  "keep",
+		"a/A.java":   "drop",
+		"NOTICE.txt": "drop",
+	})
+
+	out := mergeToReader(t, []*zip.Reader{in}, MergeOptions{StripFiles: []string{"*.java", "NOTICE.txt"}})
+
+	if got, want := len(out.File), 1; got != want {
+		t.Fatalf("len(out.File) = %d, want %d", got, want)
+	}
+	if got, want := out.File[0].Name, "a/A.class"; got != want {
+		t.Errorf("out.File[0].Name = %q, want %q", got, want)
+	}
+}
+
+func TestMergeWritesManifest(t *testing.T) {
+	in := buildZip(t, map[string]string{"META-INF/MANIFEST.MF": "old"})
+
+	out := mergeToReader(t, []*zip.Reader{in}, MergeOptions{Manifest: []byte("new")})
+
+	if got, want := entryContents(t, out, "META-INF/MANIFEST.MF"), "new"; got != want {
+		t.Errorf("META-INF/MANIFEST.MF = %q, want %q", got, want)
+	}
+}
@@ -40,7 +40,7 @@ var (
 		blueprint.RuleParams{
 			Command: `rm -rf "$outDir" "$annoDir" && mkdir -p "$outDir" "$annoDir" && ` +
 				`${config.JavacWrapper}${config.JavacCmd} ${config.JavacHeapFlags} ${config.CommonJdkFlags} ` +
-				`$javacFlags $sourcepath $bootClasspath $classpath ` +
+				`$javacFlags $sourcepath $bootClasspath $classpath $processorpath ` +
 				`-source $javaVersion -target $javaVersion ` +
 				`-d $outDir -s $annoDir @$out.rsp && ` +
 				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir`,
@@ -48,13 +48,13 @@ var (
 			Rspfile:        "$out.rsp",
 			RspfileContent: "$in",
 		},
-		"javacFlags", "sourcepath", "bootClasspath", "classpath", "outDir", "annoDir", "javaVersion")
+		"javacFlags", "sourcepath", "bootClasspath", "classpath", "processorpath", "outDir", "annoDir", "javaVersion")
 
 	errorprone = pctx.AndroidStaticRule("errorprone",
 		blueprint.RuleParams{
 			Command: `rm -rf "$outDir" "$annoDir" && mkdir -p "$outDir" "$annoDir" && ` +
 				`${config.ErrorProneCmd} ` +
-				`$javacFlags $sourcepath $bootClasspath $classpath ` +
+				`$javacFlags $sourcepath $bootClasspath $classpath $processorpath ` +
 				`-source $javaVersion -target $javaVersion ` +
 				`-d $outDir -s $annoDir @$out.rsp && ` +
 				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir`,
@@ -67,7 +67,67 @@ var (
 			Rspfile:        "$out.rsp",
 			RspfileContent: "$in",
 		},
-		"javacFlags", "sourcepath", "bootClasspath", "classpath", "outDir", "annoDir", "javaVersion")
+		"javacFlags", "sourcepath", "bootClasspath", "classpath", "processorpath", "outDir", "annoDir", "javaVersion")
+
+	// javacWorker and errorproneWorker run the same compilation as javac/errorprone, but through
+	// ${config.JavacWorker}, a thin client that talks to a long-lived daemon holding a warm JVM
+	// with javac/Error Prone already loaded (see cmd/javac_worker).  This is used instead of the
+	// javac/errorprone rules when SOONG_JAVAC_WORKERS=1 to amortize JVM startup cost across an
+	// incremental build.  --java_cmd/--worker_classpath tell the daemon which java binary and
+	// classpath to launch its warm worker subprocess with, mirroring ${config.JavaCmd} and the
+	// errorprone jars the plain errorprone rule above depends on, instead of letting it fall back
+	// to whatever "java" happens to resolve to on $PATH.
+	javacWorker = pctx.AndroidStaticRule("javacWorker",
+		blueprint.RuleParams{
+			Command: `rm -rf "$outDir" "$annoDir" && mkdir -p "$outDir" "$annoDir" && ` +
+				`${config.JavacWorker} --persistent_worker --java_cmd "${config.JavaCmd}" ` +
+				`$javacFlags $sourcepath $bootClasspath $classpath $processorpath ` +
+				`-source $javaVersion -target $javaVersion ` +
+				`-d $outDir -s $annoDir @$out.rsp && ` +
+				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir`,
+			CommandDeps: []string{
+				"${config.JavacWorker}",
+				"${config.JavaCmd}",
+				"${config.SoongZipCmd}",
+			},
+			Rspfile:        "$out.rsp",
+			RspfileContent: "$in",
+		},
+		"javacFlags", "sourcepath", "bootClasspath", "classpath", "processorpath", "outDir", "annoDir", "javaVersion")
+
+	errorproneWorker = pctx.AndroidStaticRule("errorproneWorker",
+		blueprint.RuleParams{
+			Command: `rm -rf "$outDir" "$annoDir" && mkdir -p "$outDir" "$annoDir" && ` +
+				`${config.JavacWorker} --persistent_worker --errorprone --java_cmd "${config.JavaCmd}" ` +
+				`--worker_classpath "${config.ErrorProneJavacJar}:${config.ErrorProneJar}" ` +
+				`$javacFlags $sourcepath $bootClasspath $classpath $processorpath ` +
+				`-source $javaVersion -target $javaVersion ` +
+				`-d $outDir -s $annoDir @$out.rsp && ` +
+				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir`,
+			CommandDeps: []string{
+				"${config.JavacWorker}",
+				"${config.JavaCmd}",
+				"${config.ErrorProneJavacJar}",
+				"${config.ErrorProneJar}",
+				"${config.SoongZipCmd}",
+			},
+			Rspfile:        "$out.rsp",
+			RspfileContent: "$in",
+		},
+		"javacFlags", "sourcepath", "bootClasspath", "classpath", "processorpath", "outDir", "annoDir", "javaVersion")
+
+	turbine = pctx.AndroidStaticRule("turbine",
+		blueprint.RuleParams{
+			Command: `rm -rf "$outDir" && mkdir -p "$outDir" && ` +
+				`${config.TurbineCmd} --output $out --temp_dir $outDir ` +
+				`--bootclasspath $bootClasspath --classpath $classpath ` +
+				`--javacopts -source $javaVersion -target $javaVersion -- ` +
+				`--sources @$out.rsp`,
+			CommandDeps:    []string{"${config.TurbineCmd}"},
+			Rspfile:        "$out.rsp",
+			RspfileContent: "$in",
+		},
+		"bootClasspath", "classpath", "outDir", "javaVersion")
 
 	jar = pctx.AndroidStaticRule("jar",
 		blueprint.RuleParams{
@@ -83,6 +143,17 @@ var (
 		},
 		"jarArgs")
 
+	// combineJarFast is an alternative to combineJar that merges jars in-process via
+	// soong_jar_merge (see jar/) instead of shelling out to MergeZipsCmd.  It copies central
+	// directory entries by their raw compressed bytes rather than re-inflating and re-deflating
+	// them, which dominates link time for jars with many already-compressed entries.
+	combineJarFast = pctx.AndroidStaticRule("combineJarFast",
+		blueprint.RuleParams{
+			Command:     `${config.SoongJarMergeCmd} -o $out $jarArgs $in`,
+			CommandDeps: []string{"${config.SoongJarMergeCmd}"},
+		},
+		"jarArgs")
+
 	desugar = pctx.AndroidStaticRule("desugar",
 		blueprint.RuleParams{
 			Command: `rm -rf $dumpDir && mkdir -p $dumpDir && ` +
@@ -109,6 +180,35 @@ var (
 		},
 		"outDir", "dxFlags")
 
+	d8 = pctx.AndroidStaticRule("d8",
+		blueprint.RuleParams{
+			Command: `rm -rf "$outDir" && mkdir -p "$outDir" && ` +
+				`${config.D8Cmd} --output $outDir $d8Flags $in && ` +
+				`${config.SoongZipCmd} -o $outDir/classes.dex.jar -C $outDir -D $outDir && ` +
+				`${config.MergeZipsCmd} -D -stripFile "*.class" $out $outDir/classes.dex.jar $in`,
+			CommandDeps: []string{
+				"${config.D8Cmd}",
+				"${config.SoongZipCmd}",
+				"${config.MergeZipsCmd}",
+			},
+		},
+		"outDir", "d8Flags")
+
+	r8 = pctx.AndroidStaticRule("r8",
+		blueprint.RuleParams{
+			Command: `rm -rf "$outDir" && mkdir -p "$outDir" && ` +
+				`${config.R8Cmd} --output $outDir $r8Flags $proguardFlags ` +
+				`--pg-map-output $outDictionary --pg-usage $outUsage $in && ` +
+				`${config.SoongZipCmd} -o $outDir/classes.dex.jar -C $outDir -D $outDir && ` +
+				`${config.MergeZipsCmd} -D -stripFile "*.class" $out $outDir/classes.dex.jar $in`,
+			CommandDeps: []string{
+				"${config.R8Cmd}",
+				"${config.SoongZipCmd}",
+				"${config.MergeZipsCmd}",
+			},
+		},
+		"outDir", "r8Flags", "proguardFlags", "outUsage", "outDictionary")
+
 	jarjar = pctx.AndroidStaticRule("jarjar",
 		blueprint.RuleParams{
 			Command:     "${config.JavaCmd} -jar ${config.JarjarCmd} process $rulesFile $in $out",
@@ -122,8 +222,13 @@ func init() {
 }
 
 type javaBuilderFlags struct {
-	javacFlags    string
-	dxFlags       string
+	javacFlags string
+	// dxFlags holds flags in dx's flag dialect, consumed only by the legacy dx rule.
+	dxFlags string
+	// d8Flags holds flags in d8/r8's flag dialect (e.g. --min-api, --lib), consumed by both the
+	// d8 and r8 rules.  dx and d8/r8 don't share a flag dialect, so this is kept separate from
+	// dxFlags rather than reused across dexers.
+	d8Flags       string
 	bootClasspath classpath
 	classpath     classpath
 	systemModules classpath
@@ -131,28 +236,93 @@ type javaBuilderFlags struct {
 	aidlFlags     string
 	javaVersion   string
 
+	// platformBootclasspath holds the platform side of the bootclasspath (android.jar in the
+	// unbundled case, core-libart and friends in the platform build); libraryBootclasspath holds
+	// the updatable libraries layered on top of it (conscrypt, updatable-media, etc.).
+	// bootClasspath above remains the flattened union of the two for rules, like desugar, that
+	// don't need to tell them apart; these two are only consulted when patchModule is set.
+	platformBootclasspath classpath
+	libraryBootclasspath  classpath
+
+	// patchModule, if non-empty, is the name of a system module that this library's sources
+	// intentionally augment (for example java.base, for core-libart tests that add test classes
+	// to it), set via the patch_module Blueprint property.
+	patchModule string
+
+	// patchModuleClasspath holds the paths this library's own sources are compiled against when
+	// patchModule is set.  It's kept separate from classpath (the module's ordinary dependency
+	// classpath) because --patch-module augments a system module's contents directly, and mixing
+	// it with an unrelated dependency classpath would leak those dependencies into the module
+	// being patched.
+	patchModuleClasspath classpath
+
+	// headerClasspath is the classpath used to compile a module's header jar with Turbine.  It
+	// mirrors classpath, but with any dependencies that don't produce a header jar (for example
+	// prebuilt SDK stubs) filtered out by the caller, since Turbine can't consume them.
+	headerClasspath classpath
+
+	// processorPath is the classpath containing the output jars of the java_plugin modules this
+	// module declares in its plugins property.  If it's empty and javacFlags doesn't name a
+	// processor with -processor, -proc:none is passed instead so that classpath jars that happen
+	// to carry stray annotation processor service entries don't get run.
+	processorPath classpath
+
+	// dexer selects which tool TransformClassesJarToDexJar uses to produce the dex jar: the
+	// legacy dx, or d8/r8 (dx's replacements).  r8 additionally shrinks and obfuscates using
+	// proguardFlags/proguardFlagsFiles.
+	dexer              DexerType
+	proguardFlagsFiles android.Paths
+	proguardFlags      string
+
 	protoFlags   string
 	protoOutFlag string
 }
 
+// DexerType selects the tool used by TransformClassesJarToDexJar to convert a classes jar into a
+// dex jar.
+type DexerType int
+
+const (
+	// DexerDx uses the legacy dx command.  It is deprecated in favor of DexerD8.
+	DexerDx DexerType = iota
+	// DexerD8 uses d8, a drop-in replacement for dx.
+	DexerD8
+	// DexerR8 uses r8, which additionally shrinks and obfuscates the dex output according to
+	// the module's proguard flags.
+	DexerR8
+)
+
+// TransformJavaToClasses takes source files and returns the path to the directory containing the
+// annotation processor's generated sources, so that callers that declare plugins can expose it to
+// other tools (for example to add it to an IDE project).
 func TransformJavaToClasses(ctx android.ModuleContext, outputFile android.WritablePath,
 	srcFiles android.Paths, srcJars classpath,
-	flags javaBuilderFlags, deps android.Paths) {
+	flags javaBuilderFlags, deps android.Paths) android.Path {
 
-	transformJavaToClasses(ctx, outputFile, srcFiles, srcJars, flags, deps,
-		"", "javac", javac)
+	rule := javac
+	if ctx.AConfig().UseJavacWorkers() {
+		rule = javacWorker
+	}
+
+	return transformJavaToClasses(ctx, outputFile, srcFiles, srcJars, flags, deps,
+		"", "javac", rule)
 }
 
 func RunErrorProne(ctx android.ModuleContext, outputFile android.WritablePath,
 	srcFiles android.Paths, srcJars classpath,
-	flags javaBuilderFlags) {
+	flags javaBuilderFlags) android.Path {
 
 	if config.ErrorProneJar == "" {
 		ctx.ModuleErrorf("cannot build with Error Prone, missing external/error_prone?")
 	}
 
-	transformJavaToClasses(ctx, outputFile, srcFiles, srcJars, flags, nil,
-		"-errorprone", "errorprone", errorprone)
+	rule := errorprone
+	if ctx.AConfig().UseJavacWorkers() {
+		rule = errorproneWorker
+	}
+
+	return transformJavaToClasses(ctx, outputFile, srcFiles, srcJars, flags, nil,
+		"-errorprone", "errorprone", rule)
 }
 
 // transformJavaToClasses takes source files and converts them to a jar containing .class files.
@@ -167,7 +337,7 @@ func RunErrorProne(ctx android.ModuleContext, outputFile android.WritablePath,
 func transformJavaToClasses(ctx android.ModuleContext, outputFile android.WritablePath,
 	srcFiles android.Paths, srcJars classpath,
 	flags javaBuilderFlags, deps android.Paths,
-	intermediatesSuffix, desc string, rule blueprint.Rule) {
+	intermediatesSuffix, desc string, rule blueprint.Rule) android.Path {
 
 	deps = append(deps, srcJars...)
 
@@ -175,26 +345,100 @@ func transformJavaToClasses(ctx android.ModuleContext, outputFile android.Writab
 	if flags.javaVersion == "1.9" {
 		deps = append(deps, flags.systemModules...)
 		bootClasspath = flags.systemModules.JavaSystemModules(ctx.Device())
+		if flags.patchModule != "" {
+			deps = append(deps, flags.patchModuleClasspath...)
+			bootClasspath += " " + flags.patchModuleClasspath.JavaPatchModule(flags.patchModule)
+		}
+	} else if flags.patchModule != "" {
+		deps = append(deps, flags.platformBootclasspath...)
+		deps = append(deps, flags.libraryBootclasspath...)
+		deps = append(deps, flags.patchModuleClasspath...)
+		var patchBootclasspath []string
+		patchBootclasspath = append(patchBootclasspath, flags.platformBootclasspath.Strings()...)
+		patchBootclasspath = append(patchBootclasspath, flags.libraryBootclasspath.Strings()...)
+		patchBootclasspath = append(patchBootclasspath, flags.patchModuleClasspath.Strings()...)
+		bootClasspath = "-Xbootclasspath/p:" + strings.Join(patchBootclasspath, ":")
 	} else {
 		deps = append(deps, flags.bootClasspath...)
 		bootClasspath = flags.bootClasspath.JavaBootClasspath(ctx.Device())
 	}
 
 	deps = append(deps, flags.classpath...)
+	deps = append(deps, flags.processorPath...)
+
+	// Without any plugins, disable annotation processor discovery entirely so that stray
+	// META-INF/services/javax.annotation.processing.Processor entries on the classpath don't
+	// silently run as processors (matching javac_library's behavior under Bazel). Skip that when
+	// javacFlags already names a processor explicitly (e.g. because it's reached via the ordinary
+	// classpath rather than wired in as a java_plugin dependency), so that override isn't
+	// silently neutered by the -proc:none this appends after $javacFlags.
+	processorpath := ""
+	if len(flags.processorPath) > 0 {
+		processorpath = flags.processorPath.JavaProcessorpath()
+	} else if !hasExplicitProcessor(flags.javacFlags) {
+		processorpath = "-proc:none"
+	}
+
+	annoDir := android.PathForModuleOut(ctx, "anno"+intermediatesSuffix)
 
 	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
-		Rule:        rule,
-		Description: desc,
-		Output:      outputFile,
-		Inputs:      srcFiles,
-		Implicits:   deps,
+		Rule:            rule,
+		Description:     desc,
+		Output:          outputFile,
+		Inputs:          srcFiles,
+		Implicits:       deps,
+		ImplicitOutputs: android.WritablePaths{annoDir},
 		Args: map[string]string{
 			"javacFlags":    flags.javacFlags,
 			"bootClasspath": bootClasspath,
 			"sourcepath":    srcJars.JavaSourcepath(),
 			"classpath":     flags.classpath.JavaClasspath(),
+			"processorpath": processorpath,
 			"outDir":        android.PathForModuleOut(ctx, "classes"+intermediatesSuffix).String(),
-			"annoDir":       android.PathForModuleOut(ctx, "anno"+intermediatesSuffix).String(),
+			"annoDir":       annoDir.String(),
+			"javaVersion":   flags.javaVersion,
+		},
+	})
+
+	return annoDir
+}
+
+// hasExplicitProcessor reports whether javacFlags already requests an annotation processor via
+// -processor, so callers know not to clobber that with an auto-appended -proc:none.
+func hasExplicitProcessor(javacFlags string) bool {
+	for _, f := range strings.Fields(javacFlags) {
+		if f == "-processor" {
+			return true
+		}
+	}
+	return false
+}
+
+// TransformJavaToHeaderClasses takes source files and srcjars and produces a header jar using
+// Turbine: a jar containing stripped-down versions of the compiled classes that only preserve
+// the parts relevant to the class's ABI, such as method signatures, but omit method bodies.
+// Modules that depend on this library for compilation only, and not for the dex or runtime
+// classpath, use the header jar in place of the full javac output jar, so that changes that don't
+// affect the library's ABI (for example, a change to a method body) don't cause dependents to
+// recompile.
+func TransformJavaToHeaderClasses(ctx android.ModuleContext, outputFile android.WritablePath,
+	srcFiles android.Paths, srcJars classpath, flags javaBuilderFlags) {
+
+	var deps android.Paths
+	deps = append(deps, srcJars...)
+	deps = append(deps, flags.bootClasspath...)
+	deps = append(deps, flags.headerClasspath...)
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        turbine,
+		Description: "turbine",
+		Output:      outputFile,
+		Inputs:      srcFiles,
+		Implicits:   deps,
+		Args: map[string]string{
+			"bootClasspath": strings.Join(flags.bootClasspath.Strings(), ":"),
+			"classpath":     strings.Join(flags.headerClasspath.Strings(), ":"),
+			"outDir":        android.PathForModuleOut(ctx, "turbine").String(),
 			"javaVersion":   flags.javaVersion,
 		},
 	})
@@ -229,8 +473,13 @@ func TransformJarsToJar(ctx android.ModuleContext, outputFile android.WritablePa
 		jarArgs = append(jarArgs, "-D")
 	}
 
+	rule := combineJar
+	if ctx.AConfig().UseFastJarMerge() {
+		rule = combineJarFast
+	}
+
 	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
-		Rule:        combineJar,
+		Rule:        rule,
 		Description: "combine jars",
 		Output:      outputFile,
 		Inputs:      jars,
@@ -275,22 +524,64 @@ func TransformDesugar(ctx android.ModuleContext, outputFile android.WritablePath
 }
 
 // Converts a classes.jar file to classes*.dex, then combines the dex files with any resources
-// in the classes.jar file into a dex jar.
+// in the classes.jar file into a dex jar.  The dexerType flag selects between the legacy dx, its
+// replacement d8, and r8, which additionally shrinks and obfuscates the result.
 func TransformClassesJarToDexJar(ctx android.ModuleContext, outputFile android.WritablePath,
 	classesJar android.Path, flags javaBuilderFlags) {
 
 	outDir := android.PathForModuleOut(ctx, "dex")
 
-	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
-		Rule:        dx,
-		Description: "dx",
-		Output:      outputFile,
-		Input:       classesJar,
-		Args: map[string]string{
-			"dxFlags": flags.dxFlags,
-			"outDir":  outDir.String(),
-		},
-	})
+	switch flags.dexer {
+	case DexerR8:
+		proguardUsage := android.PathForModuleOut(ctx, "proguard_usage.txt")
+		proguardDictionary := android.PathForModuleOut(ctx, "proguard_dictionary")
+
+		var pgFlags []string
+		for _, f := range flags.proguardFlagsFiles {
+			pgFlags = append(pgFlags, "--pg-conf "+f.String())
+		}
+		if flags.proguardFlags != "" {
+			pgFlags = append(pgFlags, flags.proguardFlags)
+		}
+
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:            r8,
+			Description:     "r8",
+			Output:          outputFile,
+			Input:           classesJar,
+			Implicits:       flags.proguardFlagsFiles,
+			ImplicitOutputs: android.WritablePaths{proguardUsage, proguardDictionary},
+			Args: map[string]string{
+				"r8Flags":       flags.d8Flags,
+				"proguardFlags": strings.Join(pgFlags, " "),
+				"outDir":        outDir.String(),
+				"outUsage":      proguardUsage.String(),
+				"outDictionary": proguardDictionary.String(),
+			},
+		})
+	case DexerD8:
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:        d8,
+			Description: "d8",
+			Output:      outputFile,
+			Input:       classesJar,
+			Args: map[string]string{
+				"d8Flags": flags.d8Flags,
+				"outDir":  outDir.String(),
+			},
+		})
+	default:
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:        dx,
+			Description: "dx",
+			Output:      outputFile,
+			Input:       classesJar,
+			Args: map[string]string{
+				"dxFlags": flags.dxFlags,
+				"outDir":  outDir.String(),
+			},
+		})
+	}
 }
 
 func TransformJarJar(ctx android.ModuleContext, outputFile android.WritablePath,
@@ -365,6 +656,16 @@ func (x *classpath) JavaSystemModules(forceEmpty bool) string {
 	}
 }
 
+// JavaPatchModule returns a --patch-module argument that augments the named system module with
+// the classpath's entries, for libraries that intentionally add classes to a module they don't
+// own (for example core-libart tests adding test classes to java.base).
+func (x *classpath) JavaPatchModule(moduleName string) string {
+	if len(*x) == 0 {
+		return ""
+	}
+	return "--patch-module " + moduleName + "=" + strings.Join(x.Strings(), ":")
+}
+
 func (x *classpath) DesugarBootClasspath() []string {
 	if x == nil || *x == nil {
 		return nil
@@ -0,0 +1,67 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"android/soong/android"
+)
+
+// TestTurbineHeaderUnaffectedByMethodBodyChange builds the same library twice, with only a
+// method body differing between the two source trees, and checks that the built header jar's
+// contents are byte-for-byte identical both times. That's the whole point of
+// TransformJavaToHeaderClasses: a dependent compiling against this library's header jar should
+// not need to recompile just because a method body it can't see changed underneath it.
+func TestTurbineHeaderUnaffectedByMethodBodyChange(t *testing.T) {
+	bp := `
+		java_library {
+			name: "foo",
+			srcs: ["Foo.java"],
+		}
+	`
+
+	headerHashFor := func(src string) [sha256.Size]byte {
+		result := android.GroupFixturePreparers(
+			prepareForJavaTest,
+			android.FixtureWithRootAndroidBp(bp),
+			android.MockFS{"Foo.java": []byte(src)}.AddToFixture(),
+		).RunTest(t)
+
+		turbine := result.ModuleForTests(t, "foo", "android_common").Description("turbine")
+
+		contents, err := result.TestContext.Fs.ReadFile(turbine.Output.String())
+		if err != nil {
+			t.Fatalf("reading header jar %s: %v", turbine.Output.String(), err)
+		}
+		return sha256.Sum256(contents)
+	}
+
+	before := headerHashFor(`
+		class Foo {
+			void bar() { System.out.println("before"); }
+		}
+	`)
+	after := headerHashFor(`
+		class Foo {
+			void bar() { System.out.println("after, and much longer too"); }
+		}
+	`)
+
+	if before != after {
+		t.Errorf("header jar contents changed with only a method body edit: %x -> %x", before, after)
+	}
+}